@@ -0,0 +1,217 @@
+// Package media is a shared download/re-encode pipeline for the media URLs
+// the fetchers package produces. The sender hands it a raw CDN URL; it
+// downloads (deduplicating
+// concurrent requests for the same URL), detects the MIME type, and
+// transcodes oversized GIFs to MP4 so Telegram will accept them as a video
+// instead of silently rejecting or mangling the upload.
+package media
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GifTranscodeThreshold is the size, in bytes, above which a GIF is
+// transcoded to MP4 before being handed back to the caller.
+const GifTranscodeThreshold = 8 * 1024 * 1024
+
+// HTTPTimeout bounds a single download attempt.
+const HTTPTimeout = 30 * time.Second
+
+// ProcessedMedia is the result of downloading (and, where needed,
+// re-encoding) a single media URL. Callers own it and must call Close once
+// they're done reading so the underlying buffer can be reused.
+type ProcessedMedia struct {
+	Reader   io.ReadSeeker
+	MIME     string
+	Width    int
+	Height   int
+	Duration int
+
+	buf *bytes.Buffer
+}
+
+// Close returns the underlying buffer to the pool. It is safe to call more
+// than once.
+func (p *ProcessedMedia) Close() error {
+	if p.buf != nil {
+		putBuffer(p.buf)
+		p.buf = nil
+	}
+	return nil
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	bufferPool.Put(buf)
+}
+
+// download is the outcome of fetching a single URL, cached so that every
+// concurrent caller for the same URL observes the same bytes.
+type download struct {
+	once sync.Once
+	data []byte
+	mime string
+	err  error
+}
+
+var (
+	inflightMu sync.Mutex
+	inflight   = map[string]*download{}
+)
+
+// Process downloads url, deduplicating concurrent requests for the same URL
+// so e.g. two SendAll goroutines sending the same album only fetch it once.
+func Process(ctx context.Context, url string) (*ProcessedMedia, error) {
+	inflightMu.Lock()
+	dl, ok := inflight[url]
+	if !ok {
+		dl = &download{}
+		inflight[url] = dl
+	}
+	inflightMu.Unlock()
+
+	dl.once.Do(func() {
+		dl.data, dl.mime, dl.err = fetch(ctx, url)
+		inflightMu.Lock()
+		delete(inflight, url)
+		inflightMu.Unlock()
+	})
+
+	if dl.err != nil {
+		return nil, dl.err
+	}
+
+	pm := newProcessedMedia(ctx, dl.data, dl.mime)
+
+	if pm.MIME == "image/gif" && len(dl.data) > GifTranscodeThreshold {
+		if mp4, err := transcodeGIFToMP4(ctx, dl.data); err == nil {
+			pm.Close()
+			pm = newProcessedMedia(ctx, mp4, "video/mp4")
+		}
+	}
+
+	return pm, nil
+}
+
+func newProcessedMedia(ctx context.Context, data []byte, mime string) *ProcessedMedia {
+	buf := getBuffer()
+	buf.Write(data)
+	pm := &ProcessedMedia{
+		Reader: bytes.NewReader(buf.Bytes()),
+		MIME:   mime,
+		buf:    buf,
+	}
+
+	switch {
+	case strings.HasPrefix(mime, "image/"):
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			pm.Width, pm.Height = cfg.Width, cfg.Height
+		}
+	case strings.HasPrefix(mime, "video/"):
+		pm.Duration = probeDuration(ctx, data)
+	}
+	return pm
+}
+
+// probeDuration shells out to ffprobe (already a dependency via ffmpeg, used
+// for GIF transcoding) to read a video's duration in whole seconds. It
+// returns 0 rather than an error since a missing duration shouldn't fail the
+// whole download.
+func probeDuration(ctx context.Context, data []byte) int {
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		"pipe:0",
+	)
+	cmd.Stdin = bytes.NewReader(data)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = ioutil.Discard
+
+	if err := cmd.Run(); err != nil {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(out.String()), 64)
+	if err != nil {
+		return 0
+	}
+	return int(seconds)
+}
+
+func fetch(ctx context.Context, url string) ([]byte, string, error) {
+	client := &http.Client{Timeout: HTTPTimeout}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req = req.WithContext(ctx)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("media: %s returned status %d", url, resp.StatusCode)
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if _, err := io.Copy(buf, resp.Body); err != nil {
+		return nil, "", err
+	}
+
+	mimeType := resp.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = http.DetectContentType(buf.Bytes())
+	}
+
+	data := make([]byte, buf.Len())
+	copy(data, buf.Bytes())
+	return data, mimeType, nil
+}
+
+// transcodeGIFToMP4 pipes a GIF through ffmpeg and returns the MP4 bytes.
+func transcodeGIFToMP4(ctx context.Context, gif []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-f", "gif", "-i", "pipe:0",
+		"-movflags", "frag_keyframe+empty_moov",
+		"-pix_fmt", "yuv420p",
+		"-f", "mp4", "pipe:1",
+	)
+	cmd.Stdin = bytes.NewReader(gif)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = ioutil.Discard
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("media: ffmpeg transcode failed: %w", err)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,127 @@
+// Package oembed resolves third-party links (YouTube, Vimeo, Giphy,
+// SoundCloud, ...) into an oEmbed preview so a caption that's "just a link"
+// can still be turned into a Telegram album item.
+package oembed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Preview is the subset of an oEmbed response we care about.
+type Preview struct {
+	Title        string
+	ThumbnailURL string
+	MediaURL     string
+	IsVideo      bool
+}
+
+type provider struct {
+	name     string
+	hosts    []string
+	endpoint func(rawURL string) string
+}
+
+// providers is the declarative registry of oEmbed endpoints, keyed off the
+// link's host. Add an entry here to support a new provider.
+var providers = []provider{
+	{
+		name:  "youtube",
+		hosts: []string{"youtube.com", "youtu.be"},
+		endpoint: func(rawURL string) string {
+			return fmt.Sprintf("https://www.youtube.com/oembed?format=json&url=%s", url.QueryEscape(rawURL))
+		},
+	},
+	{
+		name:  "vimeo",
+		hosts: []string{"vimeo.com"},
+		endpoint: func(rawURL string) string {
+			return fmt.Sprintf("https://vimeo.com/api/oembed.json?url=%s", url.QueryEscape(rawURL))
+		},
+	},
+	{
+		name:  "giphy",
+		hosts: []string{"giphy.com"},
+		endpoint: func(rawURL string) string {
+			return fmt.Sprintf("https://giphy.com/services/oembed?url=%s", url.QueryEscape(rawURL))
+		},
+	},
+	{
+		name:  "soundcloud",
+		hosts: []string{"soundcloud.com"},
+		endpoint: func(rawURL string) string {
+			return fmt.Sprintf("https://soundcloud.com/oembed?format=json&url=%s", url.QueryEscape(rawURL))
+		},
+	},
+}
+
+// HTTPTimeout bounds a single oEmbed lookup.
+const HTTPTimeout = 10 * time.Second
+
+var httpClient = &http.Client{Timeout: HTTPTimeout}
+
+func providerFor(rawURL string) *provider {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	host := strings.TrimPrefix(strings.ToLower(parsed.Host), "www.")
+	for i := range providers {
+		for _, h := range providers[i].hosts {
+			if host == h || strings.HasSuffix(host, "."+h) {
+				return &providers[i]
+			}
+		}
+	}
+	return nil
+}
+
+type oembedResponse struct {
+	Type         string `json:"type"`
+	Title        string `json:"title"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	URL          string `json:"url"`
+}
+
+// Resolve looks up an oEmbed preview for rawURL using the provider registry
+// keyed off the URL's host. It returns an error if rawURL's host isn't a
+// known provider, or the provider's endpoint fails.
+func Resolve(rawURL string) (*Preview, error) {
+	p := providerFor(rawURL)
+	if p == nil {
+		return nil, fmt.Errorf("oembed: no provider for %s", rawURL)
+	}
+
+	resp, err := httpClient.Get(p.endpoint(rawURL))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oembed: %s returned status %d", p.name, resp.StatusCode)
+	}
+
+	var body oembedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	mediaURL := body.ThumbnailURL
+	if mediaURL == "" {
+		mediaURL = body.URL
+	}
+	if mediaURL == "" {
+		return nil, fmt.Errorf("oembed: %s returned no media url", p.name)
+	}
+
+	return &Preview{
+		Title:        body.Title,
+		ThumbnailURL: body.ThumbnailURL,
+		MediaURL:     mediaURL,
+		IsVideo:      body.Type == "video",
+	}, nil
+}
@@ -0,0 +1,142 @@
+package fetchers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy configures retryHTTP's backoff behavior.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy is a sane default for fetchers that don't need to tune
+// their own backoff.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// HTTPStatusError wraps a non-200 HTTP response so retryHTTP can decide
+// whether retrying is worthwhile.
+type HTTPStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("tumblr api returned status %d", e.StatusCode)
+}
+
+var retryHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// doHTTPGet performs a single GET and turns any non-200 response into an
+// *HTTPStatusError (with Retry-After parsed for a 429) so retryHTTP can
+// decide whether it's worth retrying, instead of relying on BaseFetcher's
+// plain-error HTTPGet.
+func doHTTPGet(url string) ([]byte, error) {
+	resp, err := retryHTTPClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		statusErr := &HTTPStatusError{StatusCode: resp.StatusCode}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			statusErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+		return nil, statusErr
+	}
+	return body, nil
+}
+
+// parseRetryAfter understands both forms Tumblr may send: a number of
+// seconds, or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if d := time.Until(when); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// nonRetryableStatus is the hardcoded allowlist of permanent failures: a bad
+// API key, an NSFW-gated blog, or a blog that's gone. Retrying these just
+// burns the polling window for no benefit.
+func nonRetryableStatus(status int) bool {
+	switch status {
+	case 401, 403, 404:
+		return true
+	}
+	return false
+}
+
+// retryHTTP calls get repeatedly with exponential backoff and jitter until
+// it succeeds, a permanent failure is hit (see nonRetryableStatus), or
+// policy.MaxAttempts is exhausted. It never retries a JSON parse error,
+// since that's the caller's job once retryHTTP hands back a body.
+func retryHTTP(ctx context.Context, get func(string) ([]byte, error), url string, policy RetryPolicy) ([]byte, error) {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	delay := policy.BaseDelay
+	if delay <= 0 {
+		delay = DefaultRetryPolicy.BaseDelay
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		body, err := get(url)
+		if err == nil {
+			return body, nil
+		}
+		lastErr = err
+
+		var statusErr *HTTPStatusError
+		if errors.As(err, &statusErr) {
+			if nonRetryableStatus(statusErr.StatusCode) {
+				return nil, err
+			}
+			if statusErr.StatusCode == 429 && statusErr.RetryAfter > 0 {
+				delay = statusErr.RetryAfter
+			}
+		}
+		if attempt == policy.MaxAttempts {
+			break
+		}
+
+		wait := delay + time.Duration(rand.Int63n(int64(delay)+1))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+
+		delay *= 2
+		if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+	}
+	return nil, lastErr
+}
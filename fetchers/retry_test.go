@@ -0,0 +1,46 @@
+package fetchers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNonRetryableStatus(t *testing.T) {
+	cases := map[int]bool{
+		401: true,
+		403: true,
+		404: true,
+		429: false,
+		500: false,
+		200: false,
+	}
+	for status, want := range cases {
+		if got := nonRetryableStatus(status); got != want {
+			t.Errorf("nonRetryableStatus(%d) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestParseRetryAfterSeconds(t *testing.T) {
+	got := parseRetryAfter("5")
+	if got != 5*time.Second {
+		t.Errorf("parseRetryAfter(%q) = %v, want %v", "5", got, 5*time.Second)
+	}
+}
+
+func TestParseRetryAfterHTTPDate(t *testing.T) {
+	when := time.Now().Add(10 * time.Second).UTC()
+	got := parseRetryAfter(when.Format(http.TimeFormat))
+	if got <= 0 || got > 10*time.Second {
+		t.Errorf("parseRetryAfter(%q) = %v, want a positive duration <= 10s", when, got)
+	}
+}
+
+func TestParseRetryAfterInvalid(t *testing.T) {
+	for _, value := range []string{"", "not-a-date", "-5"} {
+		if got := parseRetryAfter(value); got != 0 {
+			t.Errorf("parseRetryAfter(%q) = %v, want 0", value, got)
+		}
+	}
+}
@@ -1,91 +1,262 @@
 package fetchers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/asdine/storm"
+	"github.com/coreos/bbolt"
 	"github.com/patrickmn/go-cache"
+	"github.com/suikammd/tg_channel_bot/fetchers/oembed"
 	"log"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
+type TumblrPost struct {
+	Type               string `json:"type"`
+	BlogName           string `json:"blog_name"`
+	ID                 int64  `json:"id"`
+	PostURL            string `json:"post_url"`
+	Slug               string `json:"slug"`
+	Date               string `json:"date"`
+	Timestamp          int    `json:"timestamp"`
+	State              string `json:"state"`
+	Format             string `json:"format"`
+	ShortURL           string `json:"short_url"`
+	IsBlocksPostFormat bool   `json:"is_blocks_post_format"`
+	SourceURL          string `json:"source_url,omitempty"`
+	SourceTitle        string `json:"source_title,omitempty"`
+	Caption            string `json:"caption,omitempty"`
+	Reblog             struct {
+		Comment  string `json:"comment"`
+		TreeHTML string `json:"tree_html"`
+	} `json:"reblog"`
+	Trail []struct {
+		Post struct {
+			ID interface{} `json:"id"`
+		} `json:"post"`
+		ContentRaw string `json:"content_raw"`
+		Content    string `json:"content"`
+	} `json:"trail"`
+	VideoURL        string `json:"video_url,omitempty"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+	Duration        int    `json:"duration,omitempty"`
+	VideoType       string `json:"video_type,omitempty"`
+	DisplayAvatar   bool   `json:"display_avatar"`
+	PhotosetLayout  string `json:"photoset_layout,omitempty"`
+	Photos          []struct {
+		Caption      string `json:"caption"`
+		OriginalSize struct {
+			URL    string `json:"url"`
+			Width  int    `json:"width"`
+			Height int    `json:"height"`
+		} `json:"original_size"`
+	} `json:"photos,omitempty"`
+	ImagePermalink string `json:"image_permalink,omitempty"`
+	Title          string `json:"title,omitempty"`
+	Body           string `json:"body,omitempty"`
+	AudioURL       string `json:"audio_url,omitempty"`
+	Player         string `json:"player,omitempty"`
+	Text           string `json:"text,omitempty"`
+}
+
 type TumblrPosts struct {
 	Meta struct {
 		Status int    `json:"status"`
 		Msg    string `json:"msg"`
 	} `json:"meta"`
 	Response struct {
-		Posts []struct {
-			Type               string `json:"type"`
-			BlogName           string `json:"blog_name"`
-			ID                 int64  `json:"id"`
-			PostURL            string `json:"post_url"`
-			Slug               string `json:"slug"`
-			Date               string `json:"date"`
-			Timestamp          int    `json:"timestamp"`
-			State              string `json:"state"`
-			Format             string `json:"format"`
-			ShortURL           string `json:"short_url"`
-			IsBlocksPostFormat bool   `json:"is_blocks_post_format"`
-			SourceURL          string `json:"source_url,omitempty"`
-			SourceTitle        string `json:"source_title,omitempty"`
-			Caption            string `json:"caption,omitempty"`
-			Reblog             struct {
-				Comment  string `json:"comment"`
-				TreeHTML string `json:"tree_html"`
-			} `json:"reblog"`
-			Trail []struct {
-				Post struct {
-					ID interface{} `json:"id"`
-				} `json:"post"`
-				ContentRaw string `json:"content_raw"`
-				Content    string `json:"content"`
-			} `json:"trail"`
-			VideoURL        string `json:"video_url,omitempty"`
-			ThumbnailURL    string `json:"thumbnail_url,omitempty"`
-			ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
-			ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
-			Duration        int    `json:"duration,omitempty"`
-			VideoType       string `json:"video_type,omitempty"`
-			DisplayAvatar   bool   `json:"display_avatar"`
-			PhotosetLayout  string `json:"photoset_layout,omitempty"`
-			Photos          []struct {
-				Caption      string `json:"caption"`
-				OriginalSize struct {
-					URL    string `json:"url"`
-					Width  int    `json:"width"`
-					Height int    `json:"height"`
-				} `json:"original_size"`
-			} `json:"photos,omitempty"`
-			ImagePermalink string `json:"image_permalink,omitempty"`
-			Title          string `json:"title,omitempty"`
-			Body           string `json:"body,omitempty"`
-		} `json:"posts"`
-		TotalPosts int `json:"total_posts"`
+		Posts      []TumblrPost `json:"posts"`
+		TotalPosts int          `json:"total_posts"`
 	} `json:"response"`
 }
 
 type TumblrFetcher struct {
 	BaseFetcher
-	OAuthConsumerKey string `json:"oauth_consumer_key"`
+	OAuthConsumerKey string   `json:"oauth_consumer_key"`
+	TagFollowings    []string `json:"tag_followings"`
+	MaxAttempts      int      `json:"max_attempts"`
 	cache            *cache.Cache
+	retryPolicy      RetryPolicy
+	targetsFunc      func() []string
+}
+
+const TagFollowingPrefix = "tag:"
+
+// SetTargetsFunc lets the caller plug in a source of truth for followings
+// that lives outside this package (e.g. a storm-backed subscription store),
+// so GetPush can pick up admin-added subscriptions without the fetcher
+// importing anything from main.
+func (f *TumblrFetcher) SetTargetsFunc(targetsFunc func() []string) {
+	f.targetsFunc = targetsFunc
 }
 
 func (f *TumblrFetcher) Init(db *storm.DB) (err error) {
 	f.DB = db.From("tumblr")
 	f.cache = cache.New(cacheExp*time.Hour, cachePurge*time.Hour)
+	f.retryPolicy = DefaultRetryPolicy
+	if f.MaxAttempts > 0 {
+		f.retryPolicy.MaxAttempts = f.MaxAttempts
+	}
 	return
 }
 
+// originalPostID returns the id of the original post in a reblog trail,
+// falling back to the post's own id when the trail has fewer than two
+// entries.
+func originalPostID(p TumblrPost) string {
+	msgid := strconv.FormatInt(p.ID, 10)
+	if len(p.Trail) > 1 {
+		// We should get the original message id
+		msgid_str, ok := p.Trail[0].Post.ID.(string)
+		if ok && msgid_str != "" {
+			msgid = msgid_str
+		}
+		msgid_int64, ok := p.Trail[0].Post.ID.(int64)
+		if ok && msgid_int64 != 0 {
+			msgid = strconv.FormatInt(msgid_int64, 10)
+		}
+		// encoding/json decodes JSON numbers into interface{} as float64,
+		// so the int64 assertion above misses them and we'd silently fall
+		// back to the reblog's own id, causing dedup misses.
+		msgid_float64, ok := p.Trail[0].Post.ID.(float64)
+		if ok && msgid_float64 != 0 {
+			msgid = strconv.FormatInt(int64(msgid_float64), 10)
+		}
+	}
+	return msgid
+}
+
+// extractPhotoResources pulls photo/video resources out of a post, skipping
+// any photo already blocked under the given namespace (a blog name or a
+// "tag@{tag}" key). The post's video URL is not checked against the block
+// table.
+func (f *TumblrFetcher) extractPhotoResources(namespace string, p TumblrPost) []Resource {
+	res := make([]Resource, 0, len(p.Photos))
+	for _, photo := range p.Photos {
+		tType := TIMAGE
+		if strings.HasSuffix(strings.ToLower(photo.OriginalSize.URL), ".gif") {
+			tType = TVIDEO
+		}
+
+		strsplit := strings.Split(photo.OriginalSize.URL, "/")
+		if len(strsplit) >= 4 {
+			imghash := fmt.Sprintf("%s@%s", namespace, strsplit[3])
+			is_blocked := false
+			if err := f.DB.Get("block", imghash, &is_blocked); err == nil {
+				if is_blocked {
+					continue
+				}
+			}
+		}
+
+		res = append(res, Resource{photo.OriginalSize.URL, tType, photo.OriginalSize.URL})
+	}
+	if p.VideoURL != "" {
+		res = append(res, Resource{p.VideoURL, TVIDEO, p.VideoURL})
+	}
+	return res
+}
+
+// isSupportedPostType reports whether we know how to turn this Tumblr post
+// type into at least one Resource.
+func isSupportedPostType(postType string) bool {
+	switch postType {
+	case "photo", "video", "audio", "text", "quote", "link":
+		return true
+	}
+	return false
+}
+
+// TAUDIO and TTEXT extend the Resource Type enum (TIMAGE, TVIDEO) for audio
+// posts and HTML-only text/quote posts, respectively.
+const (
+	TAUDIO = TVIDEO + 1
+	TTEXT  = TAUDIO + 1
+)
+
+// extractNonMediaResources handles post types that don't carry photo/video
+// attachments: audio posts become a single TAUDIO resource, and text/quote
+// posts become a single TTEXT resource carrying the reblog tree HTML (or the
+// post body, for an original post) so it can be sent with HTML parse mode.
+func extractNonMediaResources(p TumblrPost) []Resource {
+	switch p.Type {
+	case "audio":
+		if p.AudioURL == "" {
+			return nil
+		}
+		return []Resource{{p.AudioURL, TAUDIO, p.AudioURL}}
+	case "text", "quote":
+		html := p.Reblog.TreeHTML
+		if html == "" {
+			html = p.Body
+		}
+		if html == "" {
+			return nil
+		}
+		return []Resource{{html, TTEXT, html}}
+	}
+	return nil
+}
+
+var urlPattern = regexp.MustCompile(`https?://[^\s"'<>]+`)
+
+// oembedCacheTTL is longer than the post-dedup cache's default expiration,
+// since a resolved link preview doesn't go stale the way "have we seen this
+// post" tracking does.
+const oembedCacheTTL = 24 * time.Hour
+
+// extractOembedResources scans a post's caption and reblog trail for
+// embedded links (YouTube/Vimeo/Giphy/SoundCloud, ...) and resolves them
+// through the oembed provider registry. This turns a bare "reblog with a
+// link" post, which otherwise produces no photo/video resources, into an
+// actionable album item.
+func (f *TumblrFetcher) extractOembedResources(p TumblrPost) []Resource {
+	urls := urlPattern.FindAllString(p.Caption, -1)
+	urls = append(urls, urlPattern.FindAllString(p.Reblog.TreeHTML, -1)...)
+	for _, t := range p.Trail {
+		urls = append(urls, urlPattern.FindAllString(t.Content, -1)...)
+	}
+
+	res := make([]Resource, 0, len(urls))
+	for _, u := range urls {
+		cacheKey := fmt.Sprintf("oembed@%s", u)
+		var preview oembed.Preview
+		if cached, found := f.cache.Get(cacheKey); found {
+			preview = cached.(oembed.Preview)
+		} else {
+			resolved, err := oembed.Resolve(u)
+			if err != nil {
+				continue
+			}
+			preview = *resolved
+			f.cache.Set(cacheKey, preview, oembedCacheTTL)
+		}
+		if preview.MediaURL == "" {
+			continue
+		}
+		tType := TIMAGE
+		if preview.IsVideo {
+			tType = TVIDEO
+		}
+		res = append(res, Resource{preview.MediaURL, tType, preview.MediaURL})
+	}
+	return res
+}
+
 func (f *TumblrFetcher) getUserTimeline(user string, time int64) ([]ReplyMessage, error) {
 	if f.OAuthConsumerKey == "" {
 		return []ReplyMessage{}, errors.New("Need API key.")
 	}
 	api_url := fmt.Sprintf("https://api.tumblr.com/v2/blog/%s.tumblr.com/posts?api_key=%s", user, f.OAuthConsumerKey)
-	resp_content, err := f.HTTPGet(api_url)
+	resp_content, err := retryHTTP(context.Background(), doHTTPGet, api_url, f.retryPolicy)
 	if err != nil {
 		log.Println("Unable to request tumblr api", err)
 		return []ReplyMessage{}, err
@@ -101,56 +272,73 @@ func (f *TumblrFetcher) getUserTimeline(user string, time int64) ([]ReplyMessage
 	}
 	ret := make([]ReplyMessage, 0, len(posts.Response.Posts))
 	for _, p := range posts.Response.Posts {
-		if p.Type != "photo" && p.Type != "video" {
+		if !isSupportedPostType(p.Type) {
 			continue
 		}
 		if int64(p.Timestamp) < time {
 			break
 		}
 
-		var msgid string
-		msgid = strconv.FormatInt(p.ID, 10)
-		if len(p.Trail) > 1 {
-			// We should get the original message id
-			msgid_str, ok := p.Trail[0].Post.ID.(string)
-			if ok && msgid_str != "" {
-				msgid = msgid_str
-			}
-			msgid_int64, ok := p.Trail[0].Post.ID.(int64)
-			if ok && msgid_int64 != 0 {
-				msgid = strconv.FormatInt(msgid_int64, 10)
-			}
-		}
-		msgid = fmt.Sprintf("%s@%s", user, msgid)
+		msgid := fmt.Sprintf("%s@%s", user, originalPostID(p))
 		_, found := f.cache.Get(msgid)
 		if found {
 			continue
 		}
 		f.cache.Set(msgid, true, cache.DefaultExpiration)
 
-		res := make([]Resource, 0, len(p.Photos))
-		for _, photo := range p.Photos {
-			tType := TIMAGE
-			if strings.HasSuffix(strings.ToLower(photo.OriginalSize.URL), ".gif") {
-				tType = TVIDEO
-			}
+		res := append(f.extractPhotoResources(user, p), extractNonMediaResources(p)...)
+		res = append(res, f.extractOembedResources(p)...)
+		if len(res) > 0 {
+			ret = append(ret, ReplyMessage{res, p.ShortURL, nil})
+		}
 
-			strsplit := strings.Split(photo.OriginalSize.URL,"/")
-			if len(strsplit) >=4 {
-				imghash := fmt.Sprintf("%s@%s", user, strsplit[3])
-				is_blocked := false
-				if err := f.DB.Get("block", imghash, &is_blocked); err == nil {
-					if is_blocked{
-						continue
-					}
-				}
-			}
+	}
+	return ret, nil
+}
 
-			res = append(res, Resource{photo.OriginalSize.URL, tType, photo.OriginalSize.URL})
+// getTagTimeline is the tag-subscription counterpart to getUserTimeline: it
+// walks the tagged-posts feed for a single hashtag instead of a single blog.
+func (f *TumblrFetcher) getTagTimeline(tag string, time int64) ([]ReplyMessage, error) {
+	if f.OAuthConsumerKey == "" {
+		return []ReplyMessage{}, errors.New("Need API key.")
+	}
+	api_url := fmt.Sprintf("https://api.tumblr.com/v2/tagged?tag=%s&api_key=%s&before=%d", url.QueryEscape(tag), f.OAuthConsumerKey, time)
+	resp_content, err := retryHTTP(context.Background(), doHTTPGet, api_url, f.retryPolicy)
+	if err != nil {
+		log.Println("Unable to request tumblr api", err)
+		return []ReplyMessage{}, err
+	}
+	posts := TumblrPosts{}
+	if err := json.Unmarshal(resp_content, &posts); err != nil {
+		log.Println("Unable to load json", err)
+		return []ReplyMessage{}, err
+	}
+	if posts.Meta.Status != 200 {
+		log.Println("Tumblr return err. Code", posts.Meta.Status)
+		return []ReplyMessage{}, errors.New("Tumblr api error.")
+	}
+	namespace := fmt.Sprintf("tag@%s", tag)
+	ret := make([]ReplyMessage, 0, len(posts.Response.Posts))
+	for _, p := range posts.Response.Posts {
+		if !isSupportedPostType(p.Type) {
+			continue
+		}
+		if int64(p.Timestamp) < time {
+			break
 		}
-		if p.VideoURL != "" {
-			res = append(res, Resource{p.VideoURL, TVIDEO, p.VideoURL})
+
+		// Namespaced so the same post reblogged across many blogs only
+		// counts once against this tag, instead of polluting per-user
+		// dedup keys.
+		msgid := fmt.Sprintf("%s@%s", namespace, originalPostID(p))
+		_, found := f.cache.Get(msgid)
+		if found {
+			continue
 		}
+		f.cache.Set(msgid, true, cache.DefaultExpiration)
+
+		res := append(f.extractPhotoResources(namespace, p), extractNonMediaResources(p)...)
+		res = append(res, f.extractOembedResources(p)...)
 		if len(res) > 0 {
 			ret = append(ret, ReplyMessage{res, p.ShortURL, nil})
 		}
@@ -165,8 +353,23 @@ func (f *TumblrFetcher) GetPush(userid string, followings []string) []ReplyMessa
 		last_update = 0
 	}
 	ret := make([]ReplyMessage, 0, 0)
+	if f.targetsFunc != nil {
+		followings = append(followings, f.targetsFunc()...)
+	}
 	for _, follow := range followings {
-		single, err := f.getUserTimeline(follow, last_update)
+		var single []ReplyMessage
+		var err error
+		if strings.HasPrefix(follow, TagFollowingPrefix) {
+			single, err = f.getTagTimeline(strings.TrimPrefix(follow, TagFollowingPrefix), last_update)
+		} else {
+			single, err = f.getUserTimeline(follow, last_update)
+		}
+		if err == nil {
+			ret = append(ret, single...)
+		}
+	}
+	for _, tag := range f.TagFollowings {
+		single, err := f.getTagTimeline(tag, last_update)
 		if err == nil {
 			ret = append(ret, single...)
 		}
@@ -194,3 +397,54 @@ func (f *TumblrFetcher) Block(userid string, caption string) string {
 	}
 	return "Unrecognized image caption."
 }
+
+// BlockTag is the tag-subscription counterpart to Block: it namespaces the
+// hash under "tag@{tag}" so blocking an image from a tag timeline doesn't
+// also block it for any blog following that shares the same CDN path.
+func (f *TumblrFetcher) BlockTag(tag string, caption string) string {
+	strsplit := strings.Split(caption, "/")
+	if len(strsplit) >= 4 {
+		imghash := fmt.Sprintf("tag@%s@%s", tag, strsplit[3])
+		f.DB.Set("block", imghash, true)
+		return fmt.Sprintf("%s blocked.", imghash)
+	}
+	return "Unrecognized image caption."
+}
+
+// BlockedHashes lists every image hash currently blocked, for the /block
+// list admin command. f.DB.Set stores each one under the "block" bucket
+// nested inside this fetcher's own "tumblr" bucket, so listing them means
+// walking that bucket with the underlying bolt handle directly; storm has
+// no generic "list all keys" call for its plain Get/Set store.
+func (f *TumblrFetcher) BlockedHashes() ([]string, error) {
+	var hashes []string
+	err := f.DB.Bolt.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("tumblr"))
+		if root == nil {
+			return nil
+		}
+		bucket := root.Bucket([]byte("block"))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, _ []byte) error {
+			hashes = append(hashes, string(k))
+			return nil
+		})
+	})
+	return hashes, err
+}
+
+// ClearBlocked empties the block bucket, for the /block clear admin command.
+func (f *TumblrFetcher) ClearBlocked() error {
+	return f.DB.Bolt.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte("tumblr"))
+		if root == nil {
+			return nil
+		}
+		if root.Bucket([]byte("block")) == nil {
+			return nil
+		}
+		return root.DeleteBucket([]byte("block"))
+	})
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/asdine/storm"
+	tb "github.com/ihciah/telebot"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subscription is a single fetcher/target follow, persisted so that admin
+// commands can add or remove follows without editing the JSON config and
+// restarting the bot.
+type Subscription struct {
+	ID      int    `storm:"id,increment"`
+	Fetcher string `storm:"index"`
+	Target  string
+}
+
+// SubscriptionStore owns the "subscriptions" storm bucket. The Tumblr
+// fetcher's JSON config tag followings are seeded into it on startup, and
+// each TumblrFetcher.GetPush call fetches its targets in addition to the
+// followings passed to GetPush and the fetcher's TagFollowings. Channel
+// followings from the JSON config are not seeded, so removing a
+// subscription here does not stop a follow that is also in the JSON config.
+type SubscriptionStore struct {
+	db *storm.DB
+}
+
+func NewSubscriptionStore(db *storm.DB) *SubscriptionStore {
+	return &SubscriptionStore{db: db.From("subscriptions")}
+}
+
+// Seed inserts any followings from the JSON config that aren't already
+// tracked. It's only meant to be called once, at startup.
+func (s *SubscriptionStore) Seed(fetcher string, followings []string) error {
+	existing, err := s.List(fetcher)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(existing))
+	for _, sub := range existing {
+		have[sub.Target] = true
+	}
+	for _, target := range followings {
+		if have[target] {
+			continue
+		}
+		if err := s.Add(fetcher, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add subscribes fetcher to target, ignoring the request if it's already
+// subscribed.
+func (s *SubscriptionStore) Add(fetcher string, target string) error {
+	existing, err := s.List(fetcher)
+	if err != nil {
+		return err
+	}
+	for _, sub := range existing {
+		if sub.Target == target {
+			return nil
+		}
+	}
+	return s.db.Save(&Subscription{Fetcher: fetcher, Target: target})
+}
+
+// Remove unsubscribes fetcher from target. It is a no-op if there is no
+// such subscription.
+func (s *SubscriptionStore) Remove(fetcher string, target string) error {
+	existing, err := s.List(fetcher)
+	if err != nil {
+		return err
+	}
+	for _, sub := range existing {
+		if sub.Target == target {
+			return s.db.DeleteStruct(&sub)
+		}
+	}
+	return nil
+}
+
+// RemoveID unsubscribes by storm id, as used by the HTTP admin endpoint.
+func (s *SubscriptionStore) RemoveID(id int) error {
+	return s.db.DeleteStruct(&Subscription{ID: id})
+}
+
+// List returns every subscription for fetcher, or every subscription if
+// fetcher is empty.
+func (s *SubscriptionStore) List(fetcher string) ([]Subscription, error) {
+	var subs []Subscription
+	var err error
+	if fetcher == "" {
+		err = s.db.All(&subs)
+	} else {
+		err = s.db.Find("Fetcher", fetcher, &subs)
+	}
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	return subs, nil
+}
+
+// Targets returns just the target strings for fetcher; GetPush fetches them
+// alongside the static followings config.
+func (s *SubscriptionStore) Targets(fetcher string) []string {
+	subs, err := s.List(fetcher)
+	if err != nil {
+		return nil
+	}
+	targets := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		targets = append(targets, sub.Target)
+	}
+	return targets
+}
+
+func isAdmin(admins []string, m *tb.Message) bool {
+	for _, admin := range admins {
+		if admin == m.Sender.Username || admin == strconv.Itoa(m.Sender.ID) {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterSubscriptionHandlers wires up the admin-only /sub, /unsub, /subs,
+// /cursor, /blocktag, and /block commands. It's separate from RegisterHandler
+// so the subscription-management surface can be reviewed (and, if needed,
+// disabled) on its own.
+func (TGBOT *TelegramBot) RegisterSubscriptionHandlers() {
+	TGBOT.Bot.Handle("/sub", func(m *tb.Message) {
+		if !isAdmin(TGBOT.Admins, m) {
+			return
+		}
+		args := strings.Fields(m.Payload)
+		if len(args) != 2 {
+			TGBOT.Bot.Send(m.Sender, "Usage: /sub <fetcher> <target>")
+			return
+		}
+		if err := TGBOT.Subscriptions.Add(args[0], args[1]); err != nil {
+			TGBOT.Bot.Send(m.Sender, fmt.Sprintf("Failed: %s", err))
+			return
+		}
+		TGBOT.Bot.Send(m.Sender, fmt.Sprintf("Subscribed %s to %s.", args[0], args[1]))
+	})
+
+	TGBOT.Bot.Handle("/unsub", func(m *tb.Message) {
+		if !isAdmin(TGBOT.Admins, m) {
+			return
+		}
+		args := strings.Fields(m.Payload)
+		if len(args) != 2 {
+			TGBOT.Bot.Send(m.Sender, "Usage: /unsub <fetcher> <target>")
+			return
+		}
+		if err := TGBOT.Subscriptions.Remove(args[0], args[1]); err != nil {
+			TGBOT.Bot.Send(m.Sender, fmt.Sprintf("Failed: %s", err))
+			return
+		}
+		TGBOT.Bot.Send(m.Sender, fmt.Sprintf("Unsubscribed %s from %s.", args[0], args[1]))
+	})
+
+	TGBOT.Bot.Handle("/subs", func(m *tb.Message) {
+		if !isAdmin(TGBOT.Admins, m) {
+			return
+		}
+		fetcher := strings.TrimSpace(m.Payload)
+		subs, err := TGBOT.Subscriptions.List(fetcher)
+		if err != nil {
+			TGBOT.Bot.Send(m.Sender, fmt.Sprintf("Failed: %s", err))
+			return
+		}
+		if len(subs) == 0 {
+			TGBOT.Bot.Send(m.Sender, "No subscriptions.")
+			return
+		}
+		lines := make([]string, 0, len(subs))
+		for _, sub := range subs {
+			lines = append(lines, fmt.Sprintf("%d: %s %s", sub.ID, sub.Fetcher, sub.Target))
+		}
+		TGBOT.Bot.Send(m.Sender, strings.Join(lines, "\n"))
+	})
+
+	TGBOT.Bot.Handle("/cursor", func(m *tb.Message) {
+		if !isAdmin(TGBOT.Admins, m) {
+			return
+		}
+		args := strings.Fields(m.Payload)
+		if len(args) < 1 {
+			TGBOT.Bot.Send(m.Sender, "Usage: /cursor <fetcher> [reset|show]")
+			return
+		}
+		fetcherName := args[0]
+		action := "show"
+		if len(args) > 1 {
+			action = args[1]
+		}
+		if fetcherName != "tumblr" || TGBOT.FetcherConfigs.Tumblr == nil {
+			TGBOT.Bot.Send(m.Sender, fmt.Sprintf("Unknown fetcher %s.", fetcherName))
+			return
+		}
+		userid := m.Sender.Recipient()
+		switch action {
+		case "reset":
+			if err := TGBOT.FetcherConfigs.Tumblr.GoBack(userid, time.Now().Unix()); err != nil {
+				TGBOT.Bot.Send(m.Sender, fmt.Sprintf("Failed: %s", err))
+				return
+			}
+			TGBOT.Bot.Send(m.Sender, fmt.Sprintf("%s cursor reset.", fetcherName))
+		case "show":
+			var lastUpdate int64
+			if err := TGBOT.FetcherConfigs.Tumblr.DB.Get("last_update", userid, &lastUpdate); err != nil {
+				lastUpdate = 0
+			}
+			TGBOT.Bot.Send(m.Sender, fmt.Sprintf("%s cursor: %d", fetcherName, lastUpdate))
+		default:
+			TGBOT.Bot.Send(m.Sender, "Usage: /cursor <fetcher> [reset|show]")
+		}
+	})
+
+	TGBOT.Bot.Handle("/blocktag", func(m *tb.Message) {
+		if !isAdmin(TGBOT.Admins, m) {
+			return
+		}
+		if TGBOT.FetcherConfigs.Tumblr == nil {
+			TGBOT.Bot.Send(m.Sender, "Tumblr fetcher is not configured.")
+			return
+		}
+		args := strings.SplitN(m.Payload, " ", 2)
+		if len(args) != 2 {
+			TGBOT.Bot.Send(m.Sender, "Usage: /blocktag <tag> <image caption>")
+			return
+		}
+		TGBOT.Bot.Send(m.Sender, TGBOT.FetcherConfigs.Tumblr.BlockTag(args[0], args[1]))
+	})
+
+	TGBOT.Bot.Handle("/block", func(m *tb.Message) {
+		if !isAdmin(TGBOT.Admins, m) {
+			return
+		}
+		if TGBOT.FetcherConfigs.Tumblr == nil {
+			TGBOT.Bot.Send(m.Sender, "Tumblr fetcher is not configured.")
+			return
+		}
+		args := strings.Fields(m.Payload)
+		if len(args) < 1 {
+			TGBOT.Bot.Send(m.Sender, "Usage: /block list|clear")
+			return
+		}
+		switch args[0] {
+		case "list":
+			hashes, err := TGBOT.FetcherConfigs.Tumblr.BlockedHashes()
+			if err != nil {
+				TGBOT.Bot.Send(m.Sender, fmt.Sprintf("Failed: %s", err))
+				return
+			}
+			if len(hashes) == 0 {
+				TGBOT.Bot.Send(m.Sender, "No blocked images.")
+				return
+			}
+			TGBOT.Bot.Send(m.Sender, strings.Join(hashes, "\n"))
+		case "clear":
+			if err := TGBOT.FetcherConfigs.Tumblr.ClearBlocked(); err != nil {
+				TGBOT.Bot.Send(m.Sender, fmt.Sprintf("Failed: %s", err))
+				return
+			}
+			TGBOT.Bot.Send(m.Sender, "Block table cleared.")
+		default:
+			TGBOT.Bot.Send(m.Sender, "Usage: /block list|clear")
+		}
+	})
+}
+
+// AdminHTTPConfig configures the optional companion HTTP admin endpoint.
+type AdminHTTPConfig struct {
+	BindAddr  string `json:"bind_addr"`
+	HTTPToken string `json:"http_token"`
+}
+
+// ServeAdminHTTP starts the HTTP admin endpoint if BindAddr is configured,
+// so a companion web portal can manage subscriptions the same way the chat
+// commands do. It blocks, so callers should run it in its own goroutine.
+func (TGBOT *TelegramBot) ServeAdminHTTP() error {
+	if TGBOT.AdminHTTP.BindAddr == "" {
+		return nil
+	}
+	if TGBOT.AdminHTTP.HTTPToken == "" {
+		return errors.New("admin_http.http_token must be set to serve the admin HTTP API")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subscriptions", TGBOT.handleSubscriptionsCollection)
+	mux.HandleFunc("/subscriptions/", TGBOT.handleSubscriptionsItem)
+	return http.ListenAndServe(TGBOT.AdminHTTP.BindAddr, TGBOT.authenticated(mux))
+}
+
+// authenticated checks the request against a dedicated HTTP token, not the
+// public Telegram Admins usernames isAdmin uses — those are guessable by
+// anyone who knows an admin's handle, so they must never double as a bearer
+// secret.
+func (TGBOT *TelegramBot) authenticated(next http.Handler) http.Handler {
+	expected := []byte(TGBOT.AdminHTTP.HTTPToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if len(token) == 0 || subtle.ConstantTimeCompare(token, expected) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (TGBOT *TelegramBot) handleSubscriptionsCollection(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		subs, err := TGBOT.Subscriptions.List(r.URL.Query().Get("fetcher"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(subs)
+	case http.MethodPost:
+		var sub Subscription
+		if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if sub.Fetcher == "" || sub.Target == "" {
+			http.Error(w, "fetcher and target are required", http.StatusBadRequest)
+			return
+		}
+		if err := TGBOT.Subscriptions.Add(sub.Fetcher, sub.Target); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (TGBOT *TelegramBot) handleSubscriptionsItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	idStr := strings.TrimPrefix(r.URL.Path, "/subscriptions/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	if err := TGBOT.Subscriptions.RemoveID(id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/asdine/storm"
+	"os"
+	"testing"
+)
+
+func newTestSubscriptionStore(t *testing.T) *SubscriptionStore {
+	t.Helper()
+	f, err := os.CreateTemp("", "subscriptions-*.db")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	f.Close()
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	db, err := storm.Open(f.Name())
+	if err != nil {
+		t.Fatalf("storm.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewSubscriptionStore(db)
+}
+
+func TestSubscriptionStoreAddIsIdempotent(t *testing.T) {
+	s := newTestSubscriptionStore(t)
+	if err := s.Add("tumblr", "foo"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := s.Add("tumblr", "foo"); err != nil {
+		t.Fatalf("second Add: %v", err)
+	}
+	subs, err := s.List("tumblr")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(subs) != 1 {
+		t.Fatalf("len(subs) = %d, want 1", len(subs))
+	}
+}
+
+func TestSubscriptionStoreRemove(t *testing.T) {
+	s := newTestSubscriptionStore(t)
+	if err := s.Add("tumblr", "foo"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := s.Remove("tumblr", "foo"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if got := s.Targets("tumblr"); len(got) != 0 {
+		t.Fatalf("Targets after Remove = %v, want empty", got)
+	}
+}
+
+func TestSubscriptionStoreSeedDoesNotDuplicate(t *testing.T) {
+	s := newTestSubscriptionStore(t)
+	if err := s.Add("tumblr", "foo"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := s.Seed("tumblr", []string{"foo", "bar"}); err != nil {
+		t.Fatalf("Seed: %v", err)
+	}
+	targets := s.Targets("tumblr")
+	if len(targets) != 2 {
+		t.Fatalf("Targets after Seed = %v, want 2 entries", targets)
+	}
+}
+
+func TestSubscriptionStoreTargetsIsolatesFetchers(t *testing.T) {
+	s := newTestSubscriptionStore(t)
+	if err := s.Add("tumblr", "foo"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := s.Add("rss", "bar"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if got := s.Targets("tumblr"); len(got) != 1 || got[0] != "foo" {
+		t.Fatalf("Targets(tumblr) = %v, want [foo]", got)
+	}
+}
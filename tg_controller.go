@@ -2,6 +2,8 @@ package main
 
 import (
 	f "./fetchers"
+	"github.com/suikammd/tg_channel_bot/fetchers/media"
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/asdine/storm"
@@ -9,11 +11,17 @@ import (
 	tb "github.com/ihciah/telebot"
 	"io/ioutil"
 	"log"
+	"sync"
 	"time"
 )
 
 const MaxAlbumSize = 10
 
+// sendConcurrency bounds how many ReplyMessages SendAll pushes to Telegram
+// at once, now that sends download through the shared media pipeline
+// instead of handing a bare URL to Telegram's servers.
+const sendConcurrency = 4
+
 type TelegramBot struct {
 	Bot            *tb.Bot
 	Database       *storm.DB
@@ -22,7 +30,9 @@ type TelegramBot struct {
 	DatabasePath   string        `json:"database"`
 	FetcherConfigs FetcherConfig `json:"fetcher_config"`
 	Channels       *[]*Channel
-	Admins         []string `json:"admins"`
+	Admins         []string        `json:"admins"`
+	AdminHTTP      AdminHTTPConfig `json:"admin_http"`
+	Subscriptions  *SubscriptionStore
 }
 
 func (TGBOT *TelegramBot) LoadConfig(json_path string) {
@@ -49,31 +59,98 @@ func (TGBOT *TelegramBot) LoadConfig(json_path string) {
 	if err != nil {
 		log.Fatal("[Cannot initialize database]", err)
 	}
+	TGBOT.Subscriptions = NewSubscriptionStore(TGBOT.Database)
+	if TGBOT.FetcherConfigs.Tumblr != nil {
+		tagFollowings := make([]string, len(TGBOT.FetcherConfigs.Tumblr.TagFollowings))
+		for i, tag := range TGBOT.FetcherConfigs.Tumblr.TagFollowings {
+			tagFollowings[i] = f.TagFollowingPrefix + tag
+		}
+		if err := TGBOT.Subscriptions.Seed("tumblr", tagFollowings); err != nil {
+			log.Println("[Unable to seed tumblr subscriptions]", err)
+		}
+		TGBOT.FetcherConfigs.Tumblr.SetTargetsFunc(func() []string {
+			return TGBOT.Subscriptions.Targets("tumblr")
+		})
+	}
 	log.Printf("[Bot initialized]Token: %s\nTimeout: %d\n", TGBOT.Token, TGBOT.Timeout)
 }
 
 func (TGBOT *TelegramBot) Serve() {
 	TGBOT.RegisterHandler()
+	TGBOT.RegisterSubscriptionHandlers()
+	go func() {
+		if err := TGBOT.ServeAdminHTTP(); err != nil {
+			log.Println("[Admin HTTP server stopped]", err)
+		}
+	}()
 	TGBOT.Bot.Start()
 }
 
+// buildInputMedia runs a resource through the shared media pipeline and
+// wraps the result for Telegram, falling back to a direct tb.FromURL upload
+// (the old behavior) if the download fails. The returned func must be
+// called once the media has been sent so any downloaded buffer is returned
+// to the pool.
+func buildInputMedia(ctx context.Context, r f.Resource, caption string) (tb.InputMedia, func(), error) {
+	pm, err := media.Process(ctx, r.URL)
+	if err != nil {
+		log.Println("Unable to process media, falling back to direct URL:", r.URL, err)
+		mediaFile, err := rawInputMedia(r, caption)
+		return mediaFile, func() {}, err
+	}
+
+	closer := func() { pm.Close() }
+	switch r.T {
+	case f.TIMAGE:
+		return &tb.Photo{File: tb.FromReader(pm.Reader), Caption: caption}, closer, nil
+	case f.TVIDEO:
+		return &tb.Video{File: tb.FromReader(pm.Reader), Caption: caption}, closer, nil
+	case f.TAUDIO:
+		return &tb.Audio{File: tb.FromReader(pm.Reader), Caption: caption}, closer, nil
+	default:
+		closer()
+		return nil, func() {}, errors.New("Undefined message type.")
+	}
+}
+
+func rawInputMedia(r f.Resource, caption string) (tb.InputMedia, error) {
+	switch r.T {
+	case f.TIMAGE:
+		return &tb.Photo{File: tb.FromURL(r.URL), Caption: caption}, nil
+	case f.TVIDEO:
+		return &tb.Video{File: tb.FromURL(r.URL), Caption: caption}, nil
+	case f.TAUDIO:
+		return &tb.Audio{File: tb.FromURL(r.URL), Caption: caption}, nil
+	}
+	return nil, errors.New("Undefined message type.")
+}
+
 func (TGBOT *TelegramBot) Send(to tb.Recipient, message f.ReplyMessage) error {
 	if message.Err != nil {
 		return message.Err
 	}
 
+	if len(message.Resources) == 1 && message.Resources[0].T == f.TTEXT {
+		html := message.Resources[0].URL
+		if html == "" {
+			html = message.Caption
+		}
+		if _, err := TGBOT.Bot.Send(to, html, tb.ModeHTML); err != nil {
+			log.Println("Unable to send text:", html)
+			return err
+		}
+		log.Println("Sent text post")
+		return nil
+	}
+
 	if len(message.Resources) == 1 {
 		if len(message.Caption) >= 190{
 			message.Caption = message.Caption[:191]
 		}
-		var err error
-		var mediaFile tb.InputMedia
-		if message.Resources[0].T == f.TIMAGE {
-			mediaFile = &tb.Photo{File: tb.FromURL(message.Resources[0].URL), Caption: message.Caption}
-		} else if message.Resources[0].T == f.TVIDEO {
-			mediaFile = &tb.Video{File: tb.FromURL(message.Resources[0].URL), Caption: message.Caption}
-		} else {
-			err = errors.New("Undefined message type.")
+		mediaFile, closer, err := buildInputMedia(context.Background(), message.Resources[0], message.Caption)
+		defer closer()
+		if err != nil {
+			return err
 		}
 		_, err = TGBOT.Bot.Send(to, mediaFile)
 		return err
@@ -96,13 +173,16 @@ func (TGBOT *TelegramBot) Send(to tb.Recipient, message f.ReplyMessage) error {
 		}
 		mediaFiles := make(tb.Album, 0, MaxAlbumSize)
 		for _, r := range message.Resources[i:end] {
-			if r.T == f.TIMAGE {
-				mediaFiles = append(mediaFiles, &tb.Photo{File: tb.FromURL(r.URL), Caption: message.Caption})
-			} else if r.T == f.TVIDEO {
-				mediaFiles = append(mediaFiles, &tb.Video{File: tb.FromURL(r.URL), Caption: message.Caption})
-			} else {
+			if r.T != f.TIMAGE && r.T != f.TVIDEO && r.T != f.TAUDIO {
 				continue
 			}
+			mediaFile, closer, err := buildInputMedia(context.Background(), r, message.Caption)
+			defer closer()
+			if err != nil {
+				log.Println("Unable to process resource", r.URL, err)
+				continue
+			}
+			mediaFiles = append(mediaFiles, mediaFile)
 		}
 		if _, err := TGBOT.Bot.SendAlbum(to, mediaFiles); err != nil {
 			log.Println("Unable to send album", err)
@@ -115,13 +195,19 @@ func (TGBOT *TelegramBot) Send(to tb.Recipient, message f.ReplyMessage) error {
 }
 
 func (TGBOT *TelegramBot) SendAll(to tb.Recipient, messages []f.ReplyMessage) (err error) {
-	err = nil
+	sem := make(chan struct{}, sendConcurrency)
+	var wg sync.WaitGroup
 	for _, msg := range messages {
-		//e := TGBOT.Send(to, msg)
-		//if e != nil{
-		//	err = e
-		//}
-		go TGBOT.Send(to, msg)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(msg f.ReplyMessage) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if e := TGBOT.Send(to, msg); e != nil {
+				log.Println("Unable to send message:", e)
+			}
+		}(msg)
 	}
-	return
+	wg.Wait()
+	return nil
 }